@@ -7,27 +7,42 @@
 package session
 
 import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/hmac"
-	"crypto/md5"
 	"crypto/rand"
-	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // SessionStore contains all data for one session process with specific id.
 type SessionStore interface {
-	Set(key, value interface{}) error     //set session value
-	Get(key interface{}) interface{}      //get session value
-	Delete(key interface{}) error         //delete session value
-	SessionID() string                    //back current sessionID
-	SessionRelease(w http.ResponseWriter) // release the resource & save data to provider & return the data
-	Flush() error                         //delete all data
+	Set(key, value interface{}) error //set session value
+	Get(key interface{}) interface{}  //get session value
+	Delete(key interface{}) error     //delete session value
+	SessionID() string                //back current sessionID
+	// SessionRelease releases the resource & saves data to provider, discarding
+	// any error the save produced.
+	//
+	// Deprecated: use Save, which reports save failures instead of swallowing
+	// them.
+	SessionRelease(w http.ResponseWriter)
+	// Save persists the session data through the provider and reports any
+	// error encountered, so callers started with SessionStartContext can
+	// decide whether to fail the request.
+	Save(ctx context.Context, w http.ResponseWriter) error
+	Flush() error //delete all data
 }
 
 // Provider contains global session methods and saved SessionStores.
@@ -57,22 +72,296 @@ func Register(name string, provide Provider) {
 	provides[name] = provide
 }
 
+// SessionIDGenerator generates a new session id for the given request. It must
+// return an unpredictable id. A non-nil error aborts SessionStartContext, which
+// returns it to its caller; SessionStart and SessionRegenerateId, which have no
+// error result, discard it and go on with the id the generator returned.
+type SessionIDGenerator func(r *http.Request) (string, error)
+
+var idGenerators = make(map[string]SessionIDGenerator)
+
+// RegisterIDGenerator makes a session id generator available by the provided
+// name, so it can be looked up with IDGenerator and wired into a Manager with
+// SetIDGenerator. If RegisterIDGenerator is called twice with the same name or
+// if fn is nil, it panics.
+func RegisterIDGenerator(name string, fn SessionIDGenerator) {
+	if fn == nil {
+		panic("session: RegisterIDGenerator generator is nil")
+	}
+	if _, dup := idGenerators[name]; dup {
+		panic("session: RegisterIDGenerator called twice for generator " + name)
+	}
+	idGenerators[name] = fn
+}
+
+// IDGenerator returns the generator registered under name with
+// RegisterIDGenerator, if any.
+func IDGenerator(name string) (fn SessionIDGenerator, ok bool) {
+	fn, ok = idGenerators[name]
+	return
+}
+
+// newDefaultIDGenerator builds the default SessionIDGenerator: 32 bytes read
+// from crypto/rand, HMAC-SHA256'd with hashKey and hex-encoded. Unlike the
+// generator it replaces, it mixes in no RemoteAddr or timestamp, which add no
+// entropy and leak client information into the session id.
+func newDefaultIDGenerator(hashKey string) SessionIDGenerator {
+	return func(r *http.Request) (string, error) {
+		bs := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, bs); err != nil {
+			return "", err
+		}
+		h := hmac.New(sha256.New, []byte(hashKey))
+		h.Write(bs)
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+}
+
 type managerConfig struct {
-	CookieName        string `json:"cookieName"`
-	EnableSetCookie   bool   `json:"enableSetCookie,omitempty"`
-	Gclifetime        int64  `json:"gclifetime"`
-	Maxlifetime       int64  `json:"maxLifetime"`
-	Secure            bool   `json:"secure"`
-	SessionIDHashFunc string `json:"sessionIDHashFunc"`
-	SessionIDHashKey  string `json:"sessionIDHashKey"`
-	CookieLifeTime    int    `json:"cookieLifeTime"`
-	ProviderConfig    string `json:"providerConfig"`
+	CookieName           string   `json:"cookieName"`
+	EnableSetCookie      bool     `json:"enableSetCookie,omitempty"`
+	Gclifetime           int64    `json:"gclifetime"`
+	Maxlifetime          int64    `json:"maxLifetime"`
+	Secure               bool     `json:"secure"`
+	SessionIDHashKey     string   `json:"sessionIDHashKey"`
+	CookieLifeTime       int      `json:"cookieLifeTime"`
+	ProviderConfig       string   `json:"providerConfig"`
+	CookieDomain         string   `json:"cookieDomain,omitempty"`
+	CookieSameSite       string   `json:"cookieSameSite,omitempty"` // "Lax", "Strict" or "None"; empty keeps the browser default
+	CookieSigningKeys    []string `json:"cookieSigningKeys,omitempty"`
+	CookieEncryptionKeys []string `json:"cookieEncryptionKeys,omitempty"`
+}
+
+// cookieCodec protects the sid carried in the session cookie: encode HMACs
+// (and, when encryption keys are configured, AES-GCM encrypts) the sid with
+// the first key in each list; decode accepts any key in either list, so a key
+// can be rotated with zero downtime by prepending the new key and leaving the
+// old one in place until every outstanding cookie has been reissued.
+type cookieCodec struct {
+	signingKeys    [][]byte
+	encryptionKeys [][]byte
+}
+
+func newCookieCodec(signingKeys, encryptionKeys []string) (*cookieCodec, error) {
+	if len(signingKeys) == 0 {
+		return nil, errors.New("session: at least one cookie signing key is required")
+	}
+	c := &cookieCodec{}
+	for _, k := range signingKeys {
+		c.signingKeys = append(c.signingKeys, []byte(k))
+	}
+	for _, k := range encryptionKeys {
+		switch len(k) {
+		case 16, 24, 32: // AES-128, AES-192, AES-256
+		default:
+			return nil, fmt.Errorf("session: cookie encryption key must be 16, 24 or 32 bytes, got %d", len(k))
+		}
+		c.encryptionKeys = append(c.encryptionKeys, []byte(k))
+	}
+	return c, nil
+}
+
+// encode signs (and, if configured, encrypts) sid for cookie transport.
+func (c *cookieCodec) encode(sid string) (string, error) {
+	payload := []byte(sid)
+	if len(c.encryptionKeys) > 0 {
+		var err error
+		if payload, err = gcmEncrypt(c.encryptionKeys[0], payload); err != nil {
+			return "", err
+		}
+	}
+	mac := hmac.New(sha256.New, c.signingKeys[0])
+	mac.Write(payload)
+	sig := mac.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// decode verifies and, if needed, decrypts a cookie value produced by encode.
+// It returns ok=false for any cookie that doesn't carry a valid MAC under one
+// of the configured signing keys, so a forged or stale cookie is treated as
+// if no cookie were present at all rather than as a valid, attacker-chosen sid.
+func (c *cookieCodec) decode(value string) (sid string, ok bool) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	verified := false
+	for _, key := range c.signingKeys {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(payload)
+		if hmac.Equal(mac.Sum(nil), sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return "", false
+	}
+	if len(c.encryptionKeys) == 0 {
+		return string(payload), true
+	}
+	for _, key := range c.encryptionKeys {
+		if plain, err := gcmDecrypt(key, payload); err == nil {
+			return string(plain), true
+		}
+	}
+	return "", false
+}
+
+func gcmEncrypt(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func gcmDecrypt(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("session: cookie ciphertext too short")
+	}
+	nonce, ct := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ct, nil)
+}
+
+// sameSiteFromString maps the CookieSameSite config string to an http.SameSite,
+// defaulting to http.SameSiteDefaultMode (the browser's default) for an empty
+// or unrecognized value.
+func sameSiteFromString(s string) http.SameSite {
+	switch strings.ToLower(s) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteDefaultMode
+	}
 }
 
 // Manager contains Provider and its configuration.
 type Manager struct {
 	provider Provider
 	config   *managerConfig
+	// SessionIDGenerator generates the session id used when a request carries
+	// none yet. It defaults to newDefaultIDGenerator, but may be overridden
+	// with SetIDGenerator to plug in SHA-256/HMAC-SHA-256, UUIDv4, or any
+	// other scheme.
+	SessionIDGenerator SessionIDGenerator
+	// sidLocks holds a *sidLock per sid so SessionStartContext can serialize
+	// concurrent read-modify-write cycles for the same session. Entries are
+	// refcounted and evicted by lockSID's release func once the last holder
+	// is done with them, so an anonymous visitor that never returns doesn't
+	// leak a mutex forever.
+	sidLocks sync.Map
+	// codec signs (and optionally encrypts) the sid carried in the session
+	// cookie. See SetCookieKeys to rotate its keys. Guarded by codecMu so
+	// rotation doesn't race with concurrent requests reading it.
+	codec   *cookieCodec
+	codecMu sync.RWMutex
+}
+
+func (manager *Manager) loadCodec() *cookieCodec {
+	manager.codecMu.RLock()
+	defer manager.codecMu.RUnlock()
+	return manager.codec
+}
+
+// sidLock is a refcounted mutex stored in Manager.sidLocks under a sid. ref
+// tracks the number of goroutines that currently hold or are waiting on mu,
+// so the entry can be deleted from sidLocks as soon as (and only when) no one
+// else still refers to it, instead of growing the map forever or racing a
+// fresh waiter against a deletion in progress.
+type sidLock struct {
+	mu  sync.Mutex
+	ref int32
+}
+
+// lockSID locks (creating, if necessary) the mutex guarding sid and returns a
+// release func that unlocks it and, once the last referent is done with it,
+// evicts its sidLocks entry. release is safe to call more than once: only the
+// first call has any effect, so it can be wired into both the request
+// lifecycle and an explicit Save/SessionRelease without double-unlocking.
+func (manager *Manager) lockSID(sid string) (release func()) {
+	var entry *sidLock
+	for {
+		v, _ := manager.sidLocks.LoadOrStore(sid, &sidLock{})
+		entry = v.(*sidLock)
+		atomic.AddInt32(&entry.ref, 1)
+		entry.mu.Lock()
+		if cur, ok := manager.sidLocks.Load(sid); ok && cur.(*sidLock) == entry {
+			break
+		}
+		// entry was evicted between LoadOrStore and Lock; retry with whatever
+		// is (or isn't) in the map now.
+		entry.mu.Unlock()
+		atomic.AddInt32(&entry.ref, -1)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if atomic.AddInt32(&entry.ref, -1) == 0 {
+				manager.sidLocks.Delete(sid)
+			}
+			entry.mu.Unlock()
+		})
+	}
+}
+
+// lockedSession wraps a SessionStore returned by SessionStartContext so that
+// Save and SessionRelease release the per-sid mutex once the session has been
+// persisted. release is also tied to the request context in
+// SessionStartContext, so a handler that panics or returns without calling
+// either one still frees the lock once the request ends, instead of wedging
+// every later SessionStartContext call for the same sid.
+type lockedSession struct {
+	SessionStore
+	release func()
+}
+
+func (s *lockedSession) Save(ctx context.Context, w http.ResponseWriter) error {
+	err := s.SessionStore.Save(ctx, w)
+	s.release()
+	return err
+}
+
+func (s *lockedSession) SessionRelease(w http.ResponseWriter) {
+	s.SessionStore.SessionRelease(w)
+	s.release()
+}
+
+type sessionContextKey struct{}
+
+// SessionFromContext returns the SessionStore placed in ctx by
+// SessionStartContext, if any.
+func SessionFromContext(ctx context.Context) (SessionStore, bool) {
+	session, ok := ctx.Value(sessionContextKey{}).(SessionStore)
+	return session, ok
 }
 
 // Create new Manager with provider name and json config string.
@@ -84,9 +373,8 @@ type Manager struct {
 // 5. mysql
 // json config:
 // 1. is https  default false
-// 2. hashfunc  default sha1
-// 3. hashkey default beegosessionkey
-// 4. maxage default is none
+// 2. hashkey default is a random 16-byte key
+// 3. maxage default is none
 func NewManager(provideName, config string) (*Manager, error) {
 	provider, ok := provides[provideName]
 	if !ok {
@@ -105,77 +393,174 @@ func NewManager(provideName, config string) (*Manager, error) {
 	if err != nil {
 		return nil, err
 	}
-	if cf.SessionIDHashFunc == "" {
-		cf.SessionIDHashFunc = "sha1"
-	}
 	if cf.SessionIDHashKey == "" {
 		cf.SessionIDHashKey = string(generateRandomKey(16))
 	}
 
+	signingKeys := cf.CookieSigningKeys
+	if len(signingKeys) == 0 {
+		signingKeys = []string{cf.SessionIDHashKey}
+	}
+	codec, err := newCookieCodec(signingKeys, cf.CookieEncryptionKeys)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Manager{
-		provider,
-		cf,
+		provider:           provider,
+		config:             cf,
+		SessionIDGenerator: newDefaultIDGenerator(cf.SessionIDHashKey),
+		codec:              codec,
 	}, nil
 }
 
+// SetCookieKeys rotates the keys used to sign and, optionally, encrypt the
+// session cookie. The first key in each list is used to protect new cookies;
+// every key remains valid for decoding existing ones, so a key can be retired
+// once every outstanding cookie has been reissued under the new one.
+func (manager *Manager) SetCookieKeys(signingKeys, encryptionKeys []string) error {
+	codec, err := newCookieCodec(signingKeys, encryptionKeys)
+	if err != nil {
+		return err
+	}
+	manager.codecMu.Lock()
+	manager.codec = codec
+	manager.codecMu.Unlock()
+	return nil
+}
+
+// newCookie builds the session cookie for sid using the manager's cookie
+// configuration, signing (and optionally encrypting) sid through the codec.
+func (manager *Manager) newCookie(sid string) (*http.Cookie, error) {
+	value, err := manager.loadCodec().encode(sid)
+	if err != nil {
+		return nil, err
+	}
+	cookie := &http.Cookie{
+		Name:     manager.config.CookieName,
+		Value:    value,
+		Path:     "/",
+		Domain:   manager.config.CookieDomain,
+		HttpOnly: true,
+		Secure:   manager.config.Secure,
+		SameSite: sameSiteFromString(manager.config.CookieSameSite),
+	}
+	if manager.config.CookieLifeTime >= 0 {
+		cookie.MaxAge = manager.config.CookieLifeTime
+	}
+	return cookie, nil
+}
+
+// cookieSID returns the sid carried by the request's session cookie, and
+// whether a validly-signed one was present. A cookie whose MAC doesn't verify
+// is treated the same as a missing cookie, closing the session-fixation
+// vector where an attacker-supplied sid would otherwise be accepted outright.
+func (manager *Manager) cookieSID(r *http.Request) (sid string, ok bool) {
+	cookie, err := r.Cookie(manager.config.CookieName)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return manager.loadCodec().decode(cookie.Value)
+}
+
 // Start session. generate or read the session id from http request.
 // if session id exists, return SessionStore with this id.
 func (manager *Manager) SessionStart(w http.ResponseWriter, r *http.Request) (session SessionStore) {
-	cookie, err := r.Cookie(manager.config.CookieName)
-	if err != nil || cookie.Value == "" {
-		sid := manager.sessionId(r)
+	sid, ok := manager.cookieSID(r)
+	if !ok || !manager.provider.SessionExist(sid) {
+		sid = manager.sessionId(r)
 		session, _ = manager.provider.SessionRead(sid)
-		cookie = &http.Cookie{Name: manager.config.CookieName,
-			Value:    url.QueryEscape(sid),
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   manager.config.Secure}
-		if manager.config.CookieLifeTime >= 0 {
-			cookie.MaxAge = manager.config.CookieLifeTime
+		cookie, err := manager.newCookie(sid)
+		if err != nil {
+			return
 		}
 		if manager.config.EnableSetCookie {
 			http.SetCookie(w, cookie)
 		}
 		r.AddCookie(cookie)
 	} else {
-		sid, _ := url.QueryUnescape(cookie.Value)
-		if manager.provider.SessionExist(sid) {
-			session, _ = manager.provider.SessionRead(sid)
-		} else {
-			sid = manager.sessionId(r)
-			session, _ = manager.provider.SessionRead(sid)
-			cookie = &http.Cookie{Name: manager.config.CookieName,
-				Value:    url.QueryEscape(sid),
-				Path:     "/",
-				HttpOnly: true,
-				Secure:   manager.config.Secure}
-			if manager.config.CookieLifeTime >= 0 {
-				cookie.MaxAge = manager.config.CookieLifeTime
-			}
-			if manager.config.EnableSetCookie {
-				http.SetCookie(w, cookie)
-			}
-			r.AddCookie(cookie)
-		}
+		session, _ = manager.provider.SessionRead(sid)
 	}
 	return
 }
 
+// SessionStartContext starts or resumes a session like SessionStart, but
+// reports errors instead of swallowing them and returns a new *http.Request
+// whose context carries the SessionStore, retrievable downstream with
+// SessionFromContext. It also acquires a mutex scoped to the session id, so
+// concurrent requests for the same session serialize their read-modify-write
+// cycle. The lock is released when the returned SessionStore's Save (or the
+// deprecated SessionRelease) is called, or, failing that, when ctx is done,
+// so a request that never calls either one cannot wedge the session's lock
+// for the rest of the process. Note that net/http also cancels a request's
+// context on client disconnect, which releases the lock even if the handler
+// is still running; callers that must keep serializing access across a slow
+// handler should call Save as soon as they're done mutating the session
+// rather than relying solely on this fallback.
+func (manager *Manager) SessionStartContext(ctx context.Context, w http.ResponseWriter, r *http.Request) (SessionStore, *http.Request, error) {
+	// context.AfterFunc runs its func immediately (in its own goroutine) if
+	// ctx is already done, which would release the per-sid lock before (or
+	// concurrently with) the read-modify-write cycle it's meant to
+	// serialize. Reject an already-done ctx up front instead of acquiring a
+	// lock that AfterFunc may release out from under us.
+	if err := ctx.Err(); err != nil {
+		return nil, r, err
+	}
+
+	sid, ok := manager.cookieSID(r)
+	if !ok || !manager.provider.SessionExist(sid) {
+		var err error
+		if sid, err = manager.SessionIDGenerator(r); err != nil {
+			return nil, r, err
+		}
+	}
+
+	unlock := manager.lockSID(sid)
+	stop := context.AfterFunc(ctx, unlock)
+	// release is what callers (lockedSession, the error paths below) invoke:
+	// it unregisters the now-unneeded AfterFunc callback before unlocking, so
+	// a session that finishes normally doesn't leave bookkeeping pinned to
+	// ctx until ctx itself is done.
+	release := func() {
+		stop()
+		unlock()
+	}
+	store, err := manager.provider.SessionRead(sid)
+	if err != nil {
+		release()
+		return nil, r, err
+	}
+	session := &lockedSession{SessionStore: store, release: release}
+
+	newCookie, err := manager.newCookie(sid)
+	if err != nil {
+		release()
+		return nil, r, err
+	}
+	if manager.config.EnableSetCookie {
+		http.SetCookie(w, newCookie)
+	}
+	r = r.WithContext(context.WithValue(ctx, sessionContextKey{}, SessionStore(session)))
+	r.AddCookie(newCookie)
+
+	return session, r, nil
+}
+
 // Destroy session by its id in http request cookie.
 func (manager *Manager) SessionDestroy(w http.ResponseWriter, r *http.Request) {
-	cookie, err := r.Cookie(manager.config.CookieName)
-	if err != nil || cookie.Value == "" {
+	sid, ok := manager.cookieSID(r)
+	if !ok {
 		return
-	} else {
-		manager.provider.SessionDestroy(cookie.Value)
-		expiration := time.Now()
-		cookie := http.Cookie{Name: manager.config.CookieName,
-			Path:     "/",
-			HttpOnly: true,
-			Expires:  expiration,
-			MaxAge:   -1}
-		http.SetCookie(w, &cookie)
 	}
+	manager.provider.SessionDestroy(sid)
+	expiration := time.Now()
+	cookie := http.Cookie{Name: manager.config.CookieName,
+		Path:     "/",
+		Domain:   manager.config.CookieDomain,
+		HttpOnly: true,
+		Expires:  expiration,
+		MaxAge:   -1}
+	http.SetCookie(w, &cookie)
 }
 
 // Get SessionStore by its id.
@@ -194,25 +579,14 @@ func (manager *Manager) GC() {
 // Regenerate a session id for this SessionStore who's id is saving in http request.
 func (manager *Manager) SessionRegenerateId(w http.ResponseWriter, r *http.Request) (session SessionStore) {
 	sid := manager.sessionId(r)
-	cookie, err := r.Cookie(manager.config.CookieName)
-	if err != nil && cookie.Value == "" {
-		//delete old cookie
-		session, _ = manager.provider.SessionRead(sid)
-		cookie = &http.Cookie{Name: manager.config.CookieName,
-			Value:    url.QueryEscape(sid),
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   manager.config.Secure,
-		}
-	} else {
-		oldsid, _ := url.QueryUnescape(cookie.Value)
+	if oldsid, ok := manager.cookieSID(r); ok {
 		session, _ = manager.provider.SessionRegenerate(oldsid, sid)
-		cookie.Value = url.QueryEscape(sid)
-		cookie.HttpOnly = true
-		cookie.Path = "/"
+	} else {
+		session, _ = manager.provider.SessionRead(sid)
 	}
-	if manager.config.CookieLifeTime >= 0 {
-		cookie.MaxAge = manager.config.CookieLifeTime
+	cookie, err := manager.newCookie(sid)
+	if err != nil {
+		return
 	}
 	http.SetCookie(w, cookie)
 	r.AddCookie(cookie)
@@ -224,10 +598,27 @@ func (manager *Manager) GetActiveSession() int {
 	return manager.provider.SessionAll()
 }
 
-// Set hash function for generating session id.
+// SetHashFunc sets the key used by the default SessionIDGenerator.
+//
+// Deprecated: hasfunc is ignored -- the default generator is unconditionally
+// HMAC-SHA256 (see newDefaultIDGenerator); there is no algorithm left to
+// select. Use SetHashKey, which takes only the key, or SetIDGenerator to
+// replace the algorithm entirely.
 func (manager *Manager) SetHashFunc(hasfunc, hashkey string) {
-	manager.config.SessionIDHashFunc = hasfunc
+	manager.SetHashKey(hashkey)
+}
+
+// SetHashKey sets the key used to HMAC new session ids and rebuilds the
+// default SessionIDGenerator around it.
+func (manager *Manager) SetHashKey(hashkey string) {
 	manager.config.SessionIDHashKey = hashkey
+	manager.SessionIDGenerator = newDefaultIDGenerator(hashkey)
+}
+
+// SetIDGenerator overrides the SessionIDGenerator used by SessionStart and
+// SessionRegenerateId.
+func (manager *Manager) SetIDGenerator(fn SessionIDGenerator) {
+	manager.SessionIDGenerator = fn
 }
 
 // Set cookie with https.
@@ -235,25 +626,8 @@ func (manager *Manager) SetSecure(secure bool) {
 	manager.config.Secure = secure
 }
 
-// generate session id with rand string, unix nano time, remote addr by hash function.
+// generate session id through the manager's SessionIDGenerator.
 func (manager *Manager) sessionId(r *http.Request) (sid string) {
-	bs := make([]byte, 24)
-	if _, err := io.ReadFull(rand.Reader, bs); err != nil {
-		return ""
-	}
-	sig := fmt.Sprintf("%s%d%s", r.RemoteAddr, time.Now().UnixNano(), bs)
-	if manager.config.SessionIDHashFunc == "md5" {
-		h := md5.New()
-		h.Write([]byte(sig))
-		sid = hex.EncodeToString(h.Sum(nil))
-	} else if manager.config.SessionIDHashFunc == "sha1" {
-		h := hmac.New(sha1.New, []byte(manager.config.SessionIDHashKey))
-		fmt.Fprintf(h, "%s", sig)
-		sid = hex.EncodeToString(h.Sum(nil))
-	} else {
-		h := hmac.New(sha1.New, []byte(manager.config.SessionIDHashKey))
-		fmt.Fprintf(h, "%s", sig)
-		sid = hex.EncodeToString(h.Sum(nil))
-	}
+	sid, _ = manager.SessionIDGenerator(r)
 	return
 }
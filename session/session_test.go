@@ -0,0 +1,386 @@
+// Beego (http://beego.me/)
+// @description beego is an open-source, high-performance web framework for the Go programming language.
+// @link        http://github.com/DiogoDoreto/beego for the canonical source repository
+// @license     http://github.com/DiogoDoreto/beego/blob/master/LICENSE
+// @authors     astaxie
+
+package session
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeStore is a minimal in-memory SessionStore used by the tests in this
+// file; it has no persistence and exists only to exercise Manager's locking
+// and cookie-handling logic.
+type fakeStore struct {
+	sid  string
+	data map[interface{}]interface{}
+}
+
+func (s *fakeStore) Set(key, value interface{}) error {
+	s.data[key] = value
+	return nil
+}
+
+func (s *fakeStore) Get(key interface{}) interface{} { return s.data[key] }
+
+func (s *fakeStore) Delete(key interface{}) error {
+	delete(s.data, key)
+	return nil
+}
+
+func (s *fakeStore) SessionID() string { return s.sid }
+
+func (s *fakeStore) SessionRelease(w http.ResponseWriter) {}
+
+func (s *fakeStore) Save(ctx context.Context, w http.ResponseWriter) error { return nil }
+
+func (s *fakeStore) Flush() error {
+	s.data = map[interface{}]interface{}{}
+	return nil
+}
+
+// fakeProvider is a minimal in-memory Provider backing fakeStore.
+type fakeProvider struct {
+	mu     sync.Mutex
+	stores map[string]*fakeStore
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{stores: make(map[string]*fakeStore)}
+}
+
+func (p *fakeProvider) SessionInit(gclifetime int64, config string) error { return nil }
+
+func (p *fakeProvider) SessionRead(sid string) (SessionStore, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.stores[sid]
+	if !ok {
+		s = &fakeStore{sid: sid, data: make(map[interface{}]interface{})}
+		p.stores[sid] = s
+	}
+	return s, nil
+}
+
+func (p *fakeProvider) SessionExist(sid string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.stores[sid]
+	return ok
+}
+
+func (p *fakeProvider) SessionRegenerate(oldsid, sid string) (SessionStore, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &fakeStore{sid: sid, data: make(map[interface{}]interface{})}
+	if old, ok := p.stores[oldsid]; ok {
+		for k, v := range old.data {
+			s.data[k] = v
+		}
+		delete(p.stores, oldsid)
+	}
+	p.stores[sid] = s
+	return s, nil
+}
+
+func (p *fakeProvider) SessionDestroy(sid string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.stores, sid)
+	return nil
+}
+
+func (p *fakeProvider) SessionAll() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.stores)
+}
+
+func (p *fakeProvider) SessionGC() {}
+
+func newTestManager(t *testing.T) *Manager {
+	t.Helper()
+	codec, err := newCookieCodec([]string{"test-signing-key"}, nil)
+	if err != nil {
+		t.Fatalf("newCookieCodec: %v", err)
+	}
+	return &Manager{
+		provider: newFakeProvider(),
+		config: &managerConfig{
+			CookieName:      "gosessionid",
+			EnableSetCookie: true,
+			CookieLifeTime:  3600,
+		},
+		SessionIDGenerator: newDefaultIDGenerator("test-signing-key"),
+		codec:              codec,
+	}
+}
+
+// TestLockedSessionSaveThenReleaseDoesNotPanic covers the mixed-usage pattern
+// called out in review: a handler that calls Save and a deferred,
+// belt-and-suspenders SessionRelease must not crash the process with a
+// sync: unlock of unlocked mutex fatal error.
+func TestLockedSessionSaveThenReleaseDoesNotPanic(t *testing.T) {
+	manager := newTestManager(t)
+	store := &fakeStore{sid: "sid1", data: make(map[interface{}]interface{})}
+	session := &lockedSession{SessionStore: store, release: manager.lockSID("sid1")}
+
+	w := httptest.NewRecorder()
+	if err := session.Save(context.Background(), w); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	session.SessionRelease(w) // must be a no-op, not a second unlock
+}
+
+// TestSidLocksEvictedAfterRelease ensures a sidLocks entry doesn't outlive the
+// goroutines referencing it; otherwise every anonymous hit leaks a mutex.
+func TestSidLocksEvictedAfterRelease(t *testing.T) {
+	manager := newTestManager(t)
+	release := manager.lockSID("sidA")
+	if _, ok := manager.sidLocks.Load("sidA"); !ok {
+		t.Fatal("expected sidLocks to hold an entry while the lock is held")
+	}
+	release()
+	if _, ok := manager.sidLocks.Load("sidA"); ok {
+		t.Fatal("expected sidLocks entry to be evicted once the last holder released it")
+	}
+}
+
+// TestSessionStartContextReleasesLockOnContextDone ensures a handler that
+// returns (or panics) without calling Save or SessionRelease still frees the
+// per-sid lock once the request context ends, instead of wedging every later
+// SessionStartContext call for the same sid.
+func TestSessionStartContextReleasesLockOnContextDone(t *testing.T) {
+	manager := newTestManager(t)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	r1 := httptest.NewRequest("GET", "/", nil)
+	w1 := httptest.NewRecorder()
+	session1, _, err := manager.SessionStartContext(ctx1, w1, r1)
+	if err != nil {
+		t.Fatalf("first SessionStartContext: %v", err)
+	}
+	sid := session1.SessionID()
+
+	// The handler returns without ever calling Save or SessionRelease.
+	cancel1()
+
+	cookie, err := manager.newCookie(sid)
+	if err != nil {
+		t.Fatalf("newCookie: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		r2 := httptest.NewRequest("GET", "/", nil)
+		r2.AddCookie(cookie)
+		w2 := httptest.NewRecorder()
+		_, _, err := manager.SessionStartContext(context.Background(), w2, r2)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("second SessionStartContext: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("second SessionStartContext for the same sid deadlocked")
+	}
+}
+
+// TestSessionStartContextRejectsAlreadyDoneContext guards against
+// context.AfterFunc's "call immediately if ctx is already done" semantics:
+// passing a pre-canceled context must not acquire (and have it instantly
+// released out from under it by AfterFunc) a lock that's supposed to provide
+// mutual exclusion between concurrent holders of the same sid.
+func TestSessionStartContextRejectsAlreadyDoneContext(t *testing.T) {
+	manager := newTestManager(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	if _, _, err := manager.SessionStartContext(ctx, w, r); err == nil {
+		t.Fatal("expected SessionStartContext to reject an already-done context")
+	}
+}
+
+// TestSessionStartContextAlreadyDoneContextDoesNotBreakExclusion is the
+// concurrency repro from review: with one goroutine passing an already
+// canceled context and another passing a live one, at most one of them may
+// ever hold the sid's lock at a time.
+func TestSessionStartContextAlreadyDoneContextDoesNotBreakExclusion(t *testing.T) {
+	manager := newTestManager(t)
+	sid := "race-sid"
+	if _, err := manager.provider.SessionRead(sid); err != nil {
+		t.Fatalf("SessionRead: %v", err)
+	}
+	cookie, err := manager.newCookie(sid)
+	if err != nil {
+		t.Fatalf("newCookie: %v", err)
+	}
+
+	var holders int32
+	var maxHolders int32
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(canceled bool) {
+			defer wg.Done()
+			ctx := context.Background()
+			if canceled {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				cancel()
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(cookie)
+			w := httptest.NewRecorder()
+			session, _, err := manager.SessionStartContext(ctx, w, r)
+			if err != nil {
+				return // rejected up front, as expected for the canceled case
+			}
+			n := atomic.AddInt32(&holders, 1)
+			for {
+				old := atomic.LoadInt32(&maxHolders)
+				if n <= old || atomic.CompareAndSwapInt32(&maxHolders, old, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&holders, -1)
+			session.Save(context.Background(), w)
+		}(i == 0)
+	}
+	wg.Wait()
+
+	if maxHolders > 1 {
+		t.Fatalf("expected at most 1 concurrent holder of the sid lock, saw %d", maxHolders)
+	}
+}
+
+// TestSessionStartRejectsTamperedCookie closes the session-fixation vector:
+// an attacker-supplied cookie value with no valid MAC must not be accepted as
+// the session id.
+func TestSessionStartRejectsTamperedCookie(t *testing.T) {
+	manager := newTestManager(t)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: manager.config.CookieName, Value: "attacker-chosen-sid"})
+	w := httptest.NewRecorder()
+
+	session := manager.SessionStart(w, r)
+	if session.SessionID() == "attacker-chosen-sid" {
+		t.Fatal("SessionStart accepted an unsigned attacker-supplied sid")
+	}
+}
+
+func TestCookieCodecRoundTrip(t *testing.T) {
+	codec, err := newCookieCodec([]string{"k1"}, nil)
+	if err != nil {
+		t.Fatalf("newCookieCodec: %v", err)
+	}
+	encoded, err := codec.encode("mysid")
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	sid, ok := codec.decode(encoded)
+	if !ok || sid != "mysid" {
+		t.Fatalf("decode(%q) = (%q, %v), want (\"mysid\", true)", encoded, sid, ok)
+	}
+}
+
+func TestCookieCodecRejectsTamperedValue(t *testing.T) {
+	codec, err := newCookieCodec([]string{"k1"}, nil)
+	if err != nil {
+		t.Fatalf("newCookieCodec: %v", err)
+	}
+	encoded, err := codec.encode("mysid")
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if _, ok := codec.decode(encoded + "x"); ok {
+		t.Fatal("decode accepted a tampered cookie value")
+	}
+}
+
+func TestCookieCodecKeyRotation(t *testing.T) {
+	oldCodec, err := newCookieCodec([]string{"old-key"}, nil)
+	if err != nil {
+		t.Fatalf("newCookieCodec: %v", err)
+	}
+	encoded, err := oldCodec.encode("mysid")
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	rotating, err := newCookieCodec([]string{"new-key", "old-key"}, nil)
+	if err != nil {
+		t.Fatalf("newCookieCodec: %v", err)
+	}
+	if sid, ok := rotating.decode(encoded); !ok || sid != "mysid" {
+		t.Fatal("cookie signed under a still-listed retired key should decode during rotation")
+	}
+
+	retired, err := newCookieCodec([]string{"new-key"}, nil)
+	if err != nil {
+		t.Fatalf("newCookieCodec: %v", err)
+	}
+	if _, ok := retired.decode(encoded); ok {
+		t.Fatal("cookie signed under a fully-retired key must be rejected")
+	}
+}
+
+func TestCookieCodecEncryption(t *testing.T) {
+	key := strings.Repeat("k", 32) // AES-256 requires a 16/24/32-byte key
+	codec, err := newCookieCodec([]string{"sign-key"}, []string{key})
+	if err != nil {
+		t.Fatalf("newCookieCodec: %v", err)
+	}
+	encoded, err := codec.encode("mysid")
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if strings.Contains(encoded, "mysid") {
+		t.Fatal("encrypted cookie value leaks the sid in plaintext")
+	}
+	sid, ok := codec.decode(encoded)
+	if !ok || sid != "mysid" {
+		t.Fatalf("decode(%q) = (%q, %v), want (\"mysid\", true)", encoded, sid, ok)
+	}
+}
+
+func TestNewCookieCodecRejectsBadEncryptionKeyLength(t *testing.T) {
+	if _, err := newCookieCodec([]string{"sign-key"}, []string{"too-short"}); err == nil {
+		t.Fatal("expected an error for a non-AES-length encryption key")
+	}
+}
+
+func TestDefaultIDGeneratorProducesUniqueIDs(t *testing.T) {
+	gen := newDefaultIDGenerator("hash-key")
+	r := httptest.NewRequest("GET", "/", nil)
+
+	a, err := gen(r)
+	if err != nil {
+		t.Fatalf("gen: %v", err)
+	}
+	b, err := gen(r)
+	if err != nil {
+		t.Fatalf("gen: %v", err)
+	}
+	if a == b {
+		t.Fatal("expected two successive ids to differ")
+	}
+	if len(a) != 64 { // 32-byte SHA-256 HMAC, hex-encoded
+		t.Fatalf("expected a 64-character hex id, got %d characters", len(a))
+	}
+}